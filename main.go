@@ -1,12 +1,20 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"path"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -18,20 +26,84 @@ const (
 	version = "0.0.1"
 	dateTimeLayout = "2006-01-02_15-04-05"
 	duplicateSuffix = "-"
+	unknownCameraModel = "Unknown"
 )
 
 var (
-	debugFlag = kingpin.Flag("verbose", "Enable verbose output.").Short('v').Bool()
-	dryRunFlag = kingpin.Flag("dry-run", "Enable dry run mode.").Short('d').Bool()
-	dirArg    = kingpin.Arg("directory", "Directory to use.").Required().ExistingDir()
+	app = kingpin.New("photorename", "Rename photos into capture-date filenames.")
+
+	renameCmd = app.Command("rename", "Rename (or copy) photos in a directory into capture-date filenames.").Default()
+	debugFlag = renameCmd.Flag("verbose", "Enable verbose output.").Short('v').Bool()
+	dryRunFlag = renameCmd.Flag("dry-run", "Enable dry run mode.").Short('d').Bool()
+	recursiveFlag = renameCmd.Flag("recursive", "Recurse into subdirectories.").Short('r').Bool()
+	outputFlag = renameCmd.Flag("output", "Destination path, as a strftime-style template whose last segment is the filename (e.g. dist/%Y/%m/%d-%H%M%S).").Short('o').String()
+	dedupeFlag = renameCmd.Flag("dedupe", "Detect duplicate photos by content hash and skip renaming repeats.").Bool()
+	copyFlag = renameCmd.Flag("copy", "Copy into a content-addressed 'content/<hash>' tree with a parallel 'date/YYYY/MM' symlink tree, instead of renaming in place.").Bool()
+	dateSourceFlag = renameCmd.Flag("date-source", "Comma-separated, ordered list of metadata sources to try: exif, xmp, exiftool, mtime, filename.").Default("exif").String()
+	workersFlag = renameCmd.Flag("workers", "Number of concurrent metadata-parsing and rename/copy workers.").Default("4").Int()
+	groupByFlag = renameCmd.Flag("group-by", "Route renamed files into subdirectories grouped by this attribute. Supported: model.").String()
+	cameraAliasesFlag = renameCmd.Flag("camera-aliases", "Path to a JSON file mapping raw EXIF camera models to friendly folder names, e.g. {\"2304FPN6DC\": \"Xiaomi13Ultra\"}.").String()
+	dirArg    = renameCmd.Arg("directory", "Directory to use.").Required().ExistingDir()
+
+	undoCmd = app.Command("undo", "Reverse the renames recorded in a manifest.")
+	undoDryRunFlag = undoCmd.Flag("dry-run", "Enable dry run mode.").Short('d').Bool()
+	manifestArg = undoCmd.Arg("manifest", "Manifest file written by a previous rename.").Required().ExistingFile()
 
 	pictureExtensionsWhitelist = map[string]bool{
 		".jpeg": true,
 		".jpg":  true,
 		".cr2":  true,
+		".png":  true,
+		".heic": true,
+		".tiff": true,
+		".dng":  true,
+		".nef":  true,
+		".arw":  true,
 	}
+
+	filenameDateTimePatterns = []struct {
+		regexp *regexp.Regexp
+		layout string
+	}{
+		{regexp.MustCompile(`\d{8}_\d{6}`), "20060102_150405"},
+		{regexp.MustCompile(`\d{4}-\d{2}-\d{2} \d{2}\.\d{2}\.\d{2}`), "2006-01-02 15.04.05"},
+	}
+
+	xmpDateTimeRegexp = regexp.MustCompile(`(?:xmp:CreateDate|photoshop:DateCreated)="([^"]+)"`)
+
+	strftimeReplacer = strings.NewReplacer(
+		"%Y", "2006",
+		"%y", "06",
+		"%m", "01",
+		"%d", "02",
+		"%H", "15",
+		"%M", "04",
+		"%S", "05",
+	)
 )
 
+// normalizeStrftimeLayout converts a strftime-style template using the
+// %Y %y %m %d %H %M %S tokens into an equivalent Go time layout, leaving
+// path separators and any other literal characters untouched.
+func normalizeStrftimeLayout(template string) string {
+	return strftimeReplacer.Replace(template)
+}
+
+// splitDestinationTemplate splits a --output template on its last path
+// separator, e.g. "dist/%Y/%m/%d-%H%M%S" into the directory template
+// "dist/%Y/%m" and the filename template "%d-%H%M%S". A template with no
+// separator (e.g. "%Y-%m") is treated entirely as a directory template,
+// leaving the filename template empty so the caller falls back to the
+// default filename layout.
+func splitDestinationTemplate(template string) (dirTemplate string, filenameTemplate string) {
+	idx := strings.LastIndex(template, "/")
+	if idx == -1 {
+		return template, ""
+	}
+
+	return template[:idx], template[idx+1:]
+}
+
 
 type StringSet map[string]struct{}
 
@@ -66,12 +138,17 @@ func (set *StringSet) Iter() <-chan interface{} {
 
 type PhotoRename struct {
 	OriginalFilename string
+	OriginalDir string
 	PhotoCaptureTime time.Time
 	RenamedFilename string
+	DestinationDir string
+	FilenameLayout string
+	Hash string
+	CameraModel string
 }
 
 func (photoRename *PhotoRename) GetFormattedDateTime() string {
-	return photoRename.PhotoCaptureTime.Format(dateTimeLayout)
+	return photoRename.PhotoCaptureTime.Format(photoRename.FilenameLayout)
 }
 
 func (photoRename *PhotoRename) IsAlreadyFormatted() bool {
@@ -92,8 +169,8 @@ func (photoRename *PhotoRename) GetFormattedFilename(duplicateSuffixes int) stri
 	return fmt.Sprintf("%s%s%s", formattedDateTime, suffix, extension)
 }
 
-func newPhotoRename(originalFilename string, photoCaptureTime time.Time) *PhotoRename {
-	return &PhotoRename{OriginalFilename: originalFilename, PhotoCaptureTime: photoCaptureTime}
+func newPhotoRename(originalFilename string, originalDir string, photoCaptureTime time.Time, filenameLayout string) *PhotoRename {
+	return &PhotoRename{OriginalFilename: originalFilename, OriginalDir: originalDir, PhotoCaptureTime: photoCaptureTime, DestinationDir: originalDir, FilenameLayout: filenameLayout}
 }
 
 func getExtension(filename string) string {
@@ -112,74 +189,471 @@ func isPictureFile(filename string) bool {
 	return ok
 }
 
-func getPhotoDateTime(filepath string) (time.Time, error) {
-	f, err := os.Open(filepath)
-	checkErr(err)
+// MetadataProvider extracts a photo's capture time from a single source.
+// getPhotoDateTime tries a configurable, ordered list of providers and uses
+// the first one that succeeds.
+type MetadataProvider interface {
+	Name() string
+	GetDateTime(path string) (time.Time, error)
+}
+
+// getPhotoDateTime tries each provider in order and returns the first
+// successful result, or the last provider's error if none succeed.
+func getPhotoDateTime(path string, providers []MetadataProvider) (time.Time, error) {
+	var lastErr error
+	for _, provider := range providers {
+		t, err := provider.GetDateTime(path)
+		if err == nil {
+			return t, nil
+		}
+
+		lastErr = fmt.Errorf("%s: %v", provider.Name(), err)
+	}
+
+	return time.Time{}, fmt.Errorf("no metadata source could determine a date for '%s' (%v)", path, lastErr)
+}
+
+// newMetadataProviders builds the ordered provider chain named by
+// --date-source, e.g. "exif,xmp,exiftool,mtime,filename".
+func newMetadataProviders(names []string, exiftoolCacheDir string) ([]MetadataProvider, error) {
+	providers := make([]MetadataProvider, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "exif":
+			providers = append(providers, &exifMetadataProvider{})
+		case "xmp":
+			providers = append(providers, &xmpMetadataProvider{})
+		case "exiftool":
+			providers = append(providers, newExiftoolMetadataProvider(exiftoolCacheDir))
+		case "mtime":
+			providers = append(providers, &mtimeMetadataProvider{})
+		case "filename":
+			providers = append(providers, &filenameMetadataProvider{})
+		default:
+			return nil, fmt.Errorf("unknown date source '%s'", name)
+		}
+	}
+
+	return providers, nil
+}
+
+// exifMetadataProvider reads the capture time out of EXIF tags.
+type exifMetadataProvider struct{}
+
+func (provider *exifMetadataProvider) Name() string {
+	return "exif"
+}
+
+func (provider *exifMetadataProvider) GetDateTime(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
 
 	x, err := exif.Decode(f)
 	if err != nil {
 		return time.Time{}, err
 	}
 
-	t, err := x.DateTime()
+	return x.DateTime()
+}
+
+// xmpMetadataProvider reads the capture time out of a "<photo>.xmp" sidecar.
+type xmpMetadataProvider struct{}
+
+func (provider *xmpMetadataProvider) Name() string {
+	return "xmp"
+}
+
+func (provider *xmpMetadataProvider) GetDateTime(path string) (time.Time, error) {
+	data, err := ioutil.ReadFile(path + ".xmp")
 	if err != nil {
 		return time.Time{}, err
 	}
 
-	return t, nil
+	match := xmpDateTimeRegexp.FindSubmatch(data)
+	if match == nil {
+		return time.Time{}, fmt.Errorf("no date found in XMP sidecar for '%s'", path)
+	}
+
+	return time.Parse(time.RFC3339, string(match[1]))
 }
 
-func main() {
-	kingpin.Version(version)
-	kingpin.Parse()
+// exiftoolMetadataProvider shells out to `exiftool -json` and caches the raw
+// JSON output on disk, keyed by the file's content hash, so repeated runs
+// over the same photos don't re-invoke the external process.
+type exiftoolMetadataProvider struct {
+	cacheDir string
+	hasher   *Hasher
+}
 
-	directory, err := filepath.Abs(*dirArg)
-	checkErr(err)
+func newExiftoolMetadataProvider(cacheDir string) *exiftoolMetadataProvider {
+	return &exiftoolMetadataProvider{cacheDir: cacheDir, hasher: newHasher()}
+}
 
-	fmt.Printf("Looking for files in directory: %s...\n", directory)
+func (provider *exiftoolMetadataProvider) Name() string {
+	return "exiftool"
+}
 
-	fileInfos, err := ioutil.ReadDir(directory)
-	checkErr(err)
+func (provider *exiftoolMetadataProvider) GetDateTime(path string) (time.Time, error) {
+	hash, err := provider.hasher.HashFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
 
-	fmt.Println("Done.")
+	cachePath := filepath.Join(provider.cacheDir, hash+".json")
 
-	exif.RegisterParsers(mknote.All...)
+	output, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		output, err = exec.Command("exiftool", "-json", path).Output()
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if mkErr := os.MkdirAll(provider.cacheDir, 0755); mkErr == nil {
+			ioutil.WriteFile(cachePath, output, 0644)
+		}
+	}
+
+	var entries []map[string]interface{}
+	if err := json.Unmarshal(output, &entries); err != nil {
+		return time.Time{}, err
+	}
+
+	if len(entries) == 0 {
+		return time.Time{}, fmt.Errorf("exiftool returned no metadata for '%s'", path)
+	}
+
+	raw, ok := entries[0]["DateTimeOriginal"].(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("exiftool output for '%s' has no DateTimeOriginal", path)
+	}
+
+	return time.Parse("2006:01:02 15:04:05", raw)
+}
+
+// mtimeMetadataProvider falls back to the filesystem's modification time.
+type mtimeMetadataProvider struct{}
+
+func (provider *mtimeMetadataProvider) Name() string {
+	return "mtime"
+}
+
+func (provider *mtimeMetadataProvider) GetDateTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+// filenameMetadataProvider recognizes a capture time encoded directly in the
+// filename, e.g. "20060102_150405" or "2006-01-02 15.04.05".
+type filenameMetadataProvider struct{}
+
+func (provider *filenameMetadataProvider) Name() string {
+	return "filename"
+}
+
+func (provider *filenameMetadataProvider) GetDateTime(path string) (time.Time, error) {
+	filename := filepath.Base(path)
+	for _, pattern := range filenameDateTimePatterns {
+		match := pattern.regexp.FindString(filename)
+		if match != "" {
+			return time.Parse(pattern.layout, match)
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("no recognizable date pattern in filename '%s'", filename)
+}
+
+// getCameraModel reads the EXIF Model tag, used for --group-by=model.
+func getCameraModel(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	x, err := exif.Decode(f)
+	if err != nil {
+		return "", err
+	}
+
+	tag, err := x.Get(exif.Model)
+	if err != nil {
+		return "", err
+	}
+
+	return tag.StringVal()
+}
+
+// ModelResolver maps a raw EXIF camera model to a friendly folder name via a
+// user-supplied alias map, falling back to a filesystem-safe version of the
+// raw model when no alias is configured.
+type ModelResolver struct {
+	aliases map[string]string
+}
+
+func newModelResolver(aliasesPath string) (*ModelResolver, error) {
+	aliases := make(map[string]string)
+	if aliasesPath != "" {
+		data, err := ioutil.ReadFile(aliasesPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(data, &aliases); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ModelResolver{aliases: aliases}, nil
+}
+
+func (resolver *ModelResolver) Resolve(rawModel string) string {
+	if rawModel == "" {
+		return unknownCameraModel
+	}
+
+	if alias, ok := resolver.aliases[rawModel]; ok {
+		return alias
+	}
+
+	return sanitizeForFilesystem(rawModel)
+}
+
+// sanitizeForFilesystem trims surrounding whitespace and replaces characters
+// that aren't safe to use in a path segment with underscores, for camera models that haven't been given a friendly alias.
+func sanitizeForFilesystem(name string) string {
+	name = strings.TrimSpace(name)
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(name)
+}
+
+// Hasher computes content hashes used to detect duplicate photos regardless
+// of filename, streaming file contents rather than reading them into memory.
+type Hasher struct{}
+
+func newHasher() *Hasher {
+	return &Hasher{}
+}
+
+func (hasher *Hasher) HashFile(filepath string) (string, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// scannedFile is a single candidate file found under the target directory,
+// with RelDir relative to that directory ("" for files at the top level).
+type scannedFile struct {
+	Name   string
+	RelDir string
+}
+
+// reservedOutputDirs are the top-level subdirectories --copy writes its
+// content-addressed and date trees into. sourceFiles excludes them so a
+// recursive run over the same root it previously wrote into doesn't walk
+// back into its own output.
+var reservedOutputDirs = map[string]bool{
+	"content": true,
+	"date":    true,
+}
+
+// sourceFiles is the pipeline's Source stage: it walks directory and emits
+// each candidate file on out, then closes out. In non-recursive mode this is
+// a flat ioutil.ReadDir of directory; in recursive mode it's a filepath.Walk of
+// the whole tree, with each file's RelDir preserved so it can be moved back
+// into the same subdirectory it was found in. The walk skips this tool's own
+// artifacts: the top-level "content"/"date" trees --copy writes, and any
+// dotfile (the exiftool cache dir, manifest files, temp copy files).
+func sourceFiles(directory string, recursive bool, out chan<- scannedFile) error {
+	defer close(out)
+
+	if !recursive {
+		fileInfos, err := ioutil.ReadDir(directory)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range fileInfos {
+			if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+
+			out <- scannedFile{Name: f.Name()}
+		}
+
+		return nil
+	}
+
+	return filepath.Walk(directory, func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(directory, walkPath)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if walkPath != directory && (reservedOutputDirs[relPath] || strings.HasPrefix(info.Name(), ".")) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+
+		relDir := filepath.Dir(relPath)
+		if relDir == "." {
+			relDir = ""
+		}
+
+		out <- scannedFile{Name: info.Name(), RelDir: relDir}
+		return nil
+	})
+}
+
+// parsedFile is what the Parse stage hands off to the Collision stage: either
+// a fully-built PhotoRename, or enough context to explain why one couldn't be
+// produced.
+type parsedFile struct {
+	file        scannedFile
+	photoRename *PhotoRename
+	dateErr     error
+}
+
+// relPath is the key parsedFile results are sorted by before the Collision
+// stage resolves them, so collisions resolve the same way regardless of the
+// order concurrent Parse workers happen to finish in.
+func (p *parsedFile) relPath() string {
+	return filepath.Join(p.file.RelDir, p.file.Name)
+}
+
+// parsePhotos is the pipeline's Parse stage: a pool of workers reads
+// scannedFiles from in, extracts a capture time (and, if needed, a content
+// hash) for each picture file, and sends the result to out.
+func parsePhotos(in <-chan scannedFile, out chan<- parsedFile, workers int, directory string, providers []MetadataProvider, hasher *Hasher, needsHash bool, outputFlag string, destinationLayout string, filenameLayout string, groupByModel bool, modelResolver *ModelResolver) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range in {
+				sourcePath := filepath.Join(directory, f.RelDir, f.Name)
+				fmt.Printf("Processing '%s'.\n", sourcePath)
+
+				if !isPictureFile(f.Name) {
+					continue
+				}
+
+				photoDateTime, err := getPhotoDateTime(sourcePath, providers)
+				if err != nil {
+					fmt.Printf("Failed to get datetime for '%s', '%v'\n", sourcePath, err)
+					out <- parsedFile{file: f, dateErr: err}
+					continue
+				}
+
+				photoRename := newPhotoRename(f.Name, f.RelDir, photoDateTime, filenameLayout)
+				if outputFlag != "" {
+					photoRename.DestinationDir = photoDateTime.Format(destinationLayout)
+				}
+
+				if needsHash {
+					hash, err := hasher.HashFile(sourcePath)
+					checkErr(err)
+					photoRename.Hash = hash
+				}
+
+				if groupByModel {
+					rawModel, _ := getCameraModel(sourcePath)
+					photoRename.CameraModel = modelResolver.Resolve(rawModel)
+					photoRename.DestinationDir = filepath.Join(photoRename.DestinationDir, photoRename.CameraModel)
+				}
+
+				out <- parsedFile{file: f, photoRename: photoRename}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+}
+
+// resolveCollisions is the pipeline's Collision stage. It must run
+// single-threaded: it owns finalFilenames, the set of names already claimed
+// in each destination directory, and assigning duplicate suffixes against a
+// shared set isn't safe to parallelize. To keep that resolution deterministic
+// regardless of the order concurrent Parse workers finish in, it first
+// buffers every parsedFile and sorts them by source path.
+func resolveCollisions(in <-chan parsedFile, dedupe bool) []*PhotoRename {
+	parsed := make([]parsedFile, 0)
+	for p := range in {
+		parsed = append(parsed, p)
+	}
+
+	sort.Slice(parsed, func(i, j int) bool {
+		return parsed[i].relPath() < parsed[j].relPath()
+	})
 
-	// Gather all of the original files and set up the renames
 	finalFilenames := newStringSet()
+	seenHashes := newStringSet()
 	fileRenames := make([]*PhotoRename, 0)
-	for _, f := range fileInfos {
-		filename := f.Name()
-		filepath := filepath.Join(directory, filename)
 
-		fmt.Printf("Processing '%s'.\n", filepath)
+	for _, p := range parsed {
+		if p.dateErr != nil {
+			finalFilenames.Add(filepath.Join(p.file.RelDir, p.file.Name))
+			continue
+		}
+
+		rename := p.photoRename
 
-		if isPictureFile(filename) {
-			photoDateTime, err := getPhotoDateTime(filepath)
-			if err != nil {
-				fmt.Printf("Failed to get datetime for '%s', '%v'\n", filepath, err)
-				finalFilenames.Add(filename)
+		if dedupe && len(rename.Hash) > 0 {
+			if seenHashes.Contains(rename.Hash) {
+				fmt.Printf("Photo '%s' is a duplicate by content hash, skipping.\n", rename.OriginalFilename)
+				finalFilenames.Add(filepath.Join(rename.OriginalDir, rename.OriginalFilename))
 				continue
 			}
 
-			photoRename := newPhotoRename(filename, photoDateTime)
+			seenHashes.Add(rename.Hash)
+		}
 
-			if photoRename.IsAlreadyFormatted() {
-				fmt.Printf("Photo '%s' already formatted.\n", filename)
-				finalFilenames.Add(filename)
-			} else {
-				fileRenames = append(fileRenames, newPhotoRename(filename, photoDateTime))
-			}
+		if rename.DestinationDir == rename.OriginalDir && rename.IsAlreadyFormatted() {
+			fmt.Printf("Photo '%s' already formatted.\n", rename.OriginalFilename)
+			finalFilenames.Add(filepath.Join(rename.DestinationDir, rename.OriginalFilename))
+			continue
 		}
+
+		fileRenames = append(fileRenames, rename)
 	}
 
 	for _, rename := range fileRenames {
 		dupeCount := 0
 		for {
 			formattedFilename := rename.GetFormattedFilename(dupeCount)
+			key := filepath.Join(rename.DestinationDir, formattedFilename)
 
-			if !finalFilenames.Contains(formattedFilename) {
-				finalFilenames.Add(formattedFilename)
+			if !finalFilenames.Contains(key) {
+				finalFilenames.Add(key)
 				rename.RenamedFilename = formattedFilename
 				break
 			}
@@ -188,12 +662,196 @@ func main() {
 		}
 	}
 
-	for _, rename := range fileRenames {
-		processRename(rename, directory, *dryRunFlag)
-		if *dryRunFlag {
-		} else {
+	return fileRenames
+}
+
+// manifestEntry records one rename (or copy) so it can later be reversed by
+// the `undo` command.
+type manifestEntry struct {
+	OriginalPath string    `json:"original_path"`
+	NewPath      string    `json:"new_path"`
+	Timestamp    time.Time `json:"timestamp"`
+	Hash         string    `json:"hash,omitempty"`
+}
+
+// writeManifest writes entries as a JSON array to
+// ".photorename-manifest-<runTimestamp>.json" inside directory.
+func writeManifest(directory string, entries []manifestEntry, runTimestamp time.Time) (string, error) {
+	manifestPath := filepath.Join(directory, fmt.Sprintf(".photorename-manifest-%s.json", runTimestamp.Format("20060102-150405")))
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return manifestPath, ioutil.WriteFile(manifestPath, data, 0644)
+}
+
+// renamePhotos is the pipeline's Rename stage: a pool of workers performs the
+// filesystem rename (or, in --copy mode, copy-and-link) for each resolved
+// PhotoRename, and records what it did as a manifestEntry so the run can be
+// undone later. Entries are recorded even in dry-run mode, without any
+// filesystem change having happened, so --dry-run can be used to preview a
+// manifest before committing to it.
+func renamePhotos(renames []*PhotoRename, workers int, directory string, copyMode bool, dryRun bool, runTimestamp time.Time) []manifestEntry {
+	in := make(chan *PhotoRename, len(renames))
+	for _, rename := range renames {
+		in <- rename
+	}
+	close(in)
+
+	entriesCh := make(chan manifestEntry, len(renames))
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rename := range in {
+				var oldPath, newPath string
+				if copyMode {
+					oldPath, newPath = processCopy(rename, directory, dryRun)
+				} else {
+					oldPath, newPath = processRename(rename, directory, dryRun)
+				}
+
+				entriesCh <- manifestEntry{OriginalPath: oldPath, NewPath: newPath, Timestamp: runTimestamp, Hash: rename.Hash}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(entriesCh)
+
+	entries := make([]manifestEntry, 0, len(renames))
+	for entry := range entriesCh {
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func main() {
+	app.Version(version)
+
+	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+	case renameCmd.FullCommand():
+		runRename()
+	case undoCmd.FullCommand():
+		runUndo()
+	}
+}
+
+func runRename() {
+	runTimestamp := time.Now()
+
+	directory, err := filepath.Abs(*dirArg)
+	checkErr(err)
+
+	fmt.Printf("Looking for files in directory: %s...\n", directory)
+
+	exif.RegisterParsers(mknote.All...)
+
+	destinationLayout := ""
+	filenameLayout := dateTimeLayout
+	if *outputFlag != "" {
+		dirTemplate, filenameTemplate := splitDestinationTemplate(*outputFlag)
+		destinationLayout = normalizeStrftimeLayout(dirTemplate)
+		if filenameTemplate != "" {
+			filenameLayout = normalizeStrftimeLayout(filenameTemplate)
+		}
+	}
+
+	hasher := newHasher()
+	needsHash := *dedupeFlag || *copyFlag
+
+	exiftoolCacheDir := filepath.Join(directory, ".photorename-exiftool-cache")
+	providers, err := newMetadataProviders(strings.Split(*dateSourceFlag, ","), exiftoolCacheDir)
+	checkErr(err)
+
+	workers := *workersFlag
+	if workers < 1 {
+		workers = 1
+	}
+
+	groupByModel := *groupByFlag == "model"
+	modelResolver, err := newModelResolver(*cameraAliasesFlag)
+	checkErr(err)
+
+	sourceCh := make(chan scannedFile, workers*2)
+	parsedCh := make(chan parsedFile, workers*2)
+
+	sourceErrCh := make(chan error, 1)
+	go func() {
+		sourceErrCh <- sourceFiles(directory, *recursiveFlag, sourceCh)
+	}()
+
+	parsePhotos(sourceCh, parsedCh, workers, directory, providers, hasher, needsHash, *outputFlag, destinationLayout, filenameLayout, groupByModel, modelResolver)
+
+	fileRenames := resolveCollisions(parsedCh, *dedupeFlag)
+
+	checkErr(<-sourceErrCh)
+
+	fmt.Println("Done.")
+
+	entries := renamePhotos(fileRenames, workers, directory, *copyFlag, *dryRunFlag, runTimestamp)
+	if len(entries) == 0 {
+		return
+	}
 
+	manifestPath, err := writeManifest(directory, entries, runTimestamp)
+	checkErr(err)
+
+	fmt.Printf("Wrote manifest to '%s'\n", manifestPath)
+}
+
+// runUndo reverses the renames (or copies) recorded in a manifest written by
+// a previous `rename` run. A manifest entry whose new path is a symlink came
+// from --copy mode, where the original file was never moved, so undoing it
+// just removes the symlink; otherwise the file is moved back to its original
+// path.
+func runUndo() {
+	data, err := ioutil.ReadFile(*manifestArg)
+	checkErr(err)
+
+	var entries []manifestEntry
+	checkErr(json.Unmarshal(data, &entries))
+
+	for _, entry := range entries {
+		info, err := os.Lstat(entry.NewPath)
+		if err != nil {
+			fmt.Printf("Skipping '%s': %v\n", entry.NewPath, err)
+			continue
 		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if *undoDryRunFlag {
+				fmt.Printf("DRY RUN: Would remove symlink '%s'\n", entry.NewPath)
+				continue
+			}
+
+			fmt.Printf("Removing symlink '%s'\n", entry.NewPath)
+			checkErr(os.Remove(entry.NewPath))
+			continue
+		}
+
+		originalExists, err := fileExists(entry.OriginalPath)
+		checkErr(err)
+
+		if originalExists {
+			fmt.Printf("Skipping '%s': '%s' already exists\n", entry.NewPath, entry.OriginalPath)
+			continue
+		}
+
+		if *undoDryRunFlag {
+			fmt.Printf("DRY RUN: Would move '%s' back to '%s'\n", entry.NewPath, entry.OriginalPath)
+			continue
+		}
+
+		checkErr(os.MkdirAll(filepath.Dir(entry.OriginalPath), 0755))
+
+		fmt.Printf("Moving '%s' back to '%s'\n", entry.NewPath, entry.OriginalPath)
+		checkErr(os.Rename(entry.NewPath, entry.OriginalPath))
 	}
 }
 
@@ -211,13 +869,14 @@ func fileExists(filepath string) (bool, error) {
 	return false, err
 }
 
-func processRename(rename *PhotoRename, directory string, dryRun bool) {
+func processRename(rename *PhotoRename, directory string, dryRun bool) (string, string) {
 	if len(rename.RenamedFilename) == 0 {
 		panic(fmt.Sprintf("Renamed filename is empty for '%v'", rename.RenamedFilename))
 	}
 
-	oldPath := filepath.Join(directory, rename.OriginalFilename)
-	newPath := filepath.Join(directory, rename.RenamedFilename)
+	oldPath := filepath.Join(directory, rename.OriginalDir, rename.OriginalFilename)
+	newDir := filepath.Join(directory, rename.DestinationDir)
+	newPath := filepath.Join(newDir, rename.RenamedFilename)
 
 	exists, err := fileExists(newPath)
 	checkErr(err)
@@ -229,9 +888,107 @@ func processRename(rename *PhotoRename, directory string, dryRun bool) {
 	if dryRun {
 		fmt.Printf("DRY RUN: Would be renaming '%s' to '%s'\n", oldPath, newPath)
 	} else {
+		err := os.MkdirAll(newDir, 0755)
+		checkErr(err)
+
 		fmt.Printf("Renaming '%s' to '%s'\n", oldPath, newPath)
 		os.Rename(oldPath, newPath)
 	}
+
+	return oldPath, newPath
+}
+
+// copyFileAtomic copies src to dst by writing into a temp file in dst's
+// directory and renaming it into place, so a concurrent reader never sees a
+// partially-written dst and an interrupted copy never leaves one behind.
+func copyFileAtomic(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".photorename-tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+// processCopy is the --copy counterpart to processRename: instead of moving
+// the photo to a single new path, it copies it into a content-addressed
+// 'content/<first 2 hex chars>/<remaining hex chars>.ext' tree (deduplicating identical bytes
+// across photos) and symlinks it from a parallel 'date/YYYY/MM/' tree under
+// its formatted filename.
+func processCopy(rename *PhotoRename, directory string, dryRun bool) (string, string) {
+	if len(rename.RenamedFilename) == 0 {
+		panic(fmt.Sprintf("Renamed filename is empty for '%v'", rename.RenamedFilename))
+	}
+
+	if len(rename.Hash) < 2 {
+		panic(fmt.Sprintf("Missing content hash for '%s'", rename.OriginalFilename))
+	}
+
+	oldPath := filepath.Join(directory, rename.OriginalDir, rename.OriginalFilename)
+
+	contentDir := filepath.Join(directory, "content", rename.Hash[:2])
+	contentPath := filepath.Join(contentDir, rename.Hash[2:]+getExtension(rename.OriginalFilename))
+
+	// The date tree is rooted at rename.DestinationDir, the same namespace
+	// resolveCollisions dedupes RenamedFilename suffixes against, so two
+	// photos that format to the same name but came from different source
+	// directories can't collide on the same symlink path.
+	dateDir := filepath.Join(directory, "date", rename.DestinationDir, rename.PhotoCaptureTime.Format("2006"), rename.PhotoCaptureTime.Format("01"))
+	symlinkPath := filepath.Join(dateDir, rename.RenamedFilename)
+
+	if dryRun {
+		fmt.Printf("DRY RUN: Would be copying '%s' to '%s' and linking from '%s'\n", oldPath, contentPath, symlinkPath)
+		return oldPath, symlinkPath
+	}
+
+	checkErr(os.MkdirAll(contentDir, 0755))
+	checkErr(os.MkdirAll(dateDir, 0755))
+
+	contentExists, err := fileExists(contentPath)
+	checkErr(err)
+
+	if contentExists {
+		fmt.Printf("Content for '%s' already stored at '%s', skipping copy.\n", oldPath, contentPath)
+	} else {
+		fmt.Printf("Copying '%s' to '%s'\n", oldPath, contentPath)
+		checkErr(copyFileAtomic(oldPath, contentPath))
+	}
+
+	relContentPath, err := filepath.Rel(dateDir, contentPath)
+	checkErr(err)
+
+	existingTarget, err := os.Readlink(symlinkPath)
+	if err == nil {
+		if existingTarget == relContentPath {
+			fmt.Printf("Symlink '%s' already points to '%s', skipping.\n", symlinkPath, relContentPath)
+			return oldPath, symlinkPath
+		}
+
+		panic(fmt.Sprintf("Symlink '%s' already exists and points to '%s', not '%s'", symlinkPath, existingTarget, relContentPath))
+	} else if !os.IsNotExist(err) {
+		checkErr(err)
+	}
+
+	fmt.Printf("Linking '%s' to '%s'\n", symlinkPath, relContentPath)
+	checkErr(os.Symlink(relContentPath, symlinkPath))
+
+	return oldPath, symlinkPath
 }
 
 func checkErr(err error) {
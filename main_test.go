@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// shuffledParsedFiles returns a channel-ready slice of parsedFile built from
+// names, permuted by perm. All photos share a capture time so resolveCollisions
+// has to assign duplicate suffixes, which is exactly the part of the pipeline
+// that has to be order-independent.
+func shuffledParsedFiles(captureTime time.Time, names []string, perm []int) []parsedFile {
+	parsed := make([]parsedFile, len(names))
+	for i, name := range names {
+		parsed[i] = parsedFile{
+			file:        scannedFile{Name: name},
+			photoRename: newPhotoRename(name, "", captureTime, dateTimeLayout),
+		}
+	}
+
+	shuffled := make([]parsedFile, len(perm))
+	for i, p := range perm {
+		shuffled[i] = parsed[p]
+	}
+
+	return shuffled
+}
+
+func runResolveCollisions(parsed []parsedFile) []string {
+	in := make(chan parsedFile, len(parsed))
+	for _, p := range parsed {
+		in <- p
+	}
+	close(in)
+
+	renames := resolveCollisions(in, false)
+
+	names := make([]string, len(renames))
+	for i, r := range renames {
+		names[i] = r.OriginalFilename + "->" + r.RenamedFilename
+	}
+
+	return names
+}
+
+func TestResolveCollisionsDeterministicRegardlessOfScanOrder(t *testing.T) {
+	captureTime := time.Date(2024, 5, 14, 15, 30, 45, 0, time.UTC)
+	names := []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg", "e.jpg"}
+
+	base := []int{0, 1, 2, 3, 4}
+	want := runResolveCollisions(shuffledParsedFiles(captureTime, names, base))
+
+	rng := rand.New(rand.NewSource(1))
+	for trial := 0; trial < 10; trial++ {
+		perm := rng.Perm(len(names))
+		got := runResolveCollisions(shuffledParsedFiles(captureTime, names, perm))
+
+		if len(got) != len(want) {
+			t.Fatalf("trial %d: got %d renames, want %d", trial, len(got), len(want))
+		}
+
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("trial %d: rename[%d] = %q, want %q", trial, i, got[i], want[i])
+			}
+		}
+	}
+}